@@ -2,13 +2,18 @@ package nsq
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
+	"sync"
 	"time"
+
+	"github.com/golang/snappy"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 var byteSpace = []byte(" ")
@@ -106,6 +111,31 @@ func Identify(js map[string]interface{}) (*Command, error) {
 	return &Command{[]byte("IDENTIFY"), nil, body}, nil
 }
 
+// ExtContentTypeJson and ExtContentTypeMsgpack select how ext headers (PublishWithJsonExt/
+// PublishWithMsgpackExt/MPUB_EXT) are encoded on the wire.
+const (
+	ExtContentTypeJson    = "json"
+	ExtContentTypeMsgpack = "msgpack"
+)
+
+// ExtContentTypeIdentifyKey is the IDENTIFY option key used to negotiate
+// ExtContentTypeJson vs ExtContentTypeMsgpack for this connection.
+const ExtContentTypeIdentifyKey = "ext_content_type"
+
+// SetExtContentType adds the ext_content_type negotiation key to an IDENTIFY options map.
+func SetExtContentType(js map[string]interface{}, contentType string) {
+	js[ExtContentTypeIdentifyKey] = contentType
+}
+
+// IdentifyMsgpack behaves like Identify but marshals js with msgpack instead of JSON.
+func IdentifyMsgpack(js map[string]interface{}) (*Command, error) {
+	body, err := msgpack.Marshal(js)
+	if err != nil {
+		return nil, err
+	}
+	return &Command{[]byte("IDENTIFY"), nil, body}, nil
+}
+
 // Auth sends credentials for authentication
 //
 // After `Identify`, this is usually the first message sent, if auth is used.
@@ -189,14 +219,167 @@ func PublishWithJsonExt(topic string, part string, body []byte, jsonExt []byte)
 	return &Command{[]byte("PUB_EXT"), params, extBody}, nil
 }
 
-func getMPubBodyV2(bodies []*bytes.Buffer) (*bytes.Buffer, error) {
+// PublishWithMsgpackExt behaves like PublishWithJsonExt but takes an ext header that the
+// caller has already encoded with msgpack; msgpackExt is copied into the body as is.
+func PublishWithMsgpackExt(topic string, part string, body []byte, msgpackExt []byte) (*Command, error) {
+	var params = [][]byte{[]byte(topic), []byte(part)}
+	if len(msgpackExt) > 65535 {
+		return nil, errCommandArg
+	}
+	hlen := uint16(len(msgpackExt))
+	extBody := make([]byte, len(body)+2+len(msgpackExt))
+	binary.BigEndian.PutUint16(extBody, hlen)
+	copy(extBody[2:], msgpackExt)
+	copy(extBody[2+hlen:], body)
+	return &Command{[]byte("PUB_EXT"), params, extBody}, nil
+}
+
+// MessageCompression is the codec used to compress a message body before framing.
+type MessageCompression byte
+
+const (
+	CompressNone MessageCompression = iota
+	CompressSnappy
+	CompressGzip
+)
+
+// String returns the wire name codec is advertised under via MsgCompressionIdentifyKey.
+func (codec MessageCompression) String() string {
+	switch codec {
+	case CompressSnappy:
+		return "snappy"
+	case CompressGzip:
+		return "gzip"
+	}
+	return "none"
+}
+
+// MsgCompressionIdentifyKey is the IDENTIFY option clients use to negotiate
+// which MessageCompression codecs the broker supports decompressing.
+const MsgCompressionIdentifyKey = "msg_compression"
+
+// SetMsgCompression adds the msg_compression negotiation key to an IDENTIFY options map.
+func SetMsgCompression(js map[string]interface{}, codec MessageCompression) {
+	js[MsgCompressionIdentifyKey] = codec.String()
+}
+
+// compressBody compresses body with the given codec, returning it unmodified for CompressNone.
+func compressBody(codec MessageCompression, body []byte) ([]byte, error) {
+	switch codec {
+	case CompressNone:
+		return body, nil
+	case CompressSnappy:
+		var buf bytes.Buffer
+		w := snappy.NewBufferedWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errCommandArg
+}
+
+// PublishCompressed creates a new Command to write a compressed message to a given topic.
+func PublishCompressed(topic string, body []byte, codec MessageCompression) (*Command, error) {
+	compressed, err := compressBody(codec, body)
+	if err != nil {
+		return nil, err
+	}
+	framed := make([]byte, 1+len(compressed))
+	framed[0] = byte(codec)
+	copy(framed[1:], compressed)
+	var params = [][]byte{[]byte(topic)}
+	return &Command{[]byte("PUB"), params, framed}, nil
+}
+
+func getMPubBodyCompressed(bodies [][]byte, codec MessageCompression) (*bytes.Buffer, error) {
 	num := uint32(len(bodies))
-	bodySize := 4
+	buf := getMPubBuffer()
+
+	err := binary.Write(buf, binary.BigEndian, &num)
+	if err != nil {
+		return nil, err
+	}
 	for _, b := range bodies {
-		bodySize += b.Len() + 4
+		compressed, err := compressBody(codec, b)
+		if err != nil {
+			return nil, err
+		}
+		// entry length + 1-byte codec marker + uint32 original length
+		entryLen := int32(1 + 4 + len(compressed))
+		err = binary.Write(buf, binary.BigEndian, entryLen)
+		if err != nil {
+			return nil, err
+		}
+		err = buf.WriteByte(byte(codec))
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Write(buf, binary.BigEndian, uint32(len(b)))
+		if err != nil {
+			return nil, err
+		}
+		_, err = buf.Write(compressed)
+		if err != nil {
+			return nil, err
+		}
 	}
-	body := make([]byte, 0, bodySize)
-	buf := bytes.NewBuffer(body)
+	return buf, nil
+}
+
+// MultiPublishCompressed creates a new Command to write more than one compressed message to a given topic.
+func MultiPublishCompressed(topic string, bodies [][]byte, codec MessageCompression) (*Command, error) {
+	var params = [][]byte{[]byte(topic)}
+
+	buf, err := getMPubBodyCompressed(bodies, codec)
+	if err != nil {
+		return nil, err
+	}
+	return &Command{[]byte("MPUB"), params, finalizeMPubBody(buf)}, nil
+}
+
+// mpubBufferPool recycles the *bytes.Buffer instances used to build MPUB-family command bodies.
+var mpubBufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getMPubBuffer() *bytes.Buffer {
+	buf := mpubBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putMPubBuffer returns buf to the pool. Callers must have already copied
+// out anything they need from buf.Bytes(), since the backing array may be
+// reused by a subsequent getMPubBuffer call.
+func putMPubBuffer(buf *bytes.Buffer) {
+	mpubBufferPool.Put(buf)
+}
+
+// finalizeMPubBody copies buf's contents into a freshly owned slice and
+// returns buf to the pool for reuse by the next batch.
+func finalizeMPubBody(buf *bytes.Buffer) []byte {
+	body := append([]byte(nil), buf.Bytes()...)
+	putMPubBuffer(buf)
+	return body
+}
+
+func getMPubBodyV2(bodies []*bytes.Buffer) (*bytes.Buffer, error) {
+	num := uint32(len(bodies))
+	buf := getMPubBuffer()
 
 	err := binary.Write(buf, binary.BigEndian, &num)
 	if err != nil {
@@ -217,12 +400,7 @@ func getMPubBodyV2(bodies []*bytes.Buffer) (*bytes.Buffer, error) {
 
 func getMPubBody(bodies [][]byte) (*bytes.Buffer, error) {
 	num := uint32(len(bodies))
-	bodySize := 4
-	for _, b := range bodies {
-		bodySize += len(b) + 4
-	}
-	body := make([]byte, 0, bodySize)
-	buf := bytes.NewBuffer(body)
+	buf := getMPubBuffer()
 
 	err := binary.Write(buf, binary.BigEndian, &num)
 	if err != nil {
@@ -244,14 +422,10 @@ func getMPubBody(bodies [][]byte) (*bytes.Buffer, error) {
 func getMPubBodyWithJsonExt(extList []*MsgExt, bodies [][]byte) (*bytes.Buffer, error) {
 	num := uint32(len(bodies))
 	jsonExtBytesList := make([][]byte, num)
-	bodySize := 4
-	for i, b := range bodies {
-		extJsonBytes := extList[i].ToJson();
-		jsonExtBytesList[i] = extJsonBytes
-		bodySize += len(b) + 4 + 2 + len(extJsonBytes)
+	for i := range bodies {
+		jsonExtBytesList[i] = extList[i].ToJson()
 	}
-	body := make([]byte, 0, bodySize)
-	buf := bytes.NewBuffer(body)
+	buf := getMPubBuffer()
 
 	err := binary.Write(buf, binary.BigEndian, &num)
 	if err != nil {
@@ -283,12 +457,7 @@ func getMPubBodyWithJsonExt(extList []*MsgExt, bodies [][]byte) (*bytes.Buffer,
 
 func getMPubBodyForTrace(traceIDList []uint64, bodies [][]byte) (*bytes.Buffer, error) {
 	num := uint32(len(bodies))
-	bodySize := 4
-	for _, b := range bodies {
-		bodySize += len(b) + 4 + 8
-	}
-	body := make([]byte, 0, bodySize)
-	buf := bytes.NewBuffer(body)
+	buf := getMPubBuffer()
 
 	err := binary.Write(buf, binary.BigEndian, &num)
 	if err != nil {
@@ -319,7 +488,7 @@ func MultiPublishV2(topic string, bodies []*bytes.Buffer) (*Command, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Command{[]byte("MPUB"), params, buf.Bytes()}, nil
+	return &Command{[]byte("MPUB"), params, finalizeMPubBody(buf)}, nil
 }
 
 // MultiPublish creates a new Command to write more than one message to a given topic
@@ -331,7 +500,7 @@ func MultiPublish(topic string, bodies [][]byte) (*Command, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Command{[]byte("MPUB"), params, buf.Bytes()}, nil
+	return &Command{[]byte("MPUB"), params, finalizeMPubBody(buf)}, nil
 }
 
 func MultiPublishWithPartV2(topic string, part string, bodies []*bytes.Buffer) (*Command, error) {
@@ -341,7 +510,7 @@ func MultiPublishWithPartV2(topic string, part string, bodies []*bytes.Buffer) (
 	if err != nil {
 		return nil, err
 	}
-	return &Command{[]byte("MPUB"), params, buf.Bytes()}, nil
+	return &Command{[]byte("MPUB"), params, finalizeMPubBody(buf)}, nil
 }
 
 // MultiPublish creates a new Command to write more than one message to a given topic
@@ -353,7 +522,7 @@ func MultiPublishWithPart(topic string, part string, bodies [][]byte) (*Command,
 	if err != nil {
 		return nil, err
 	}
-	return &Command{[]byte("MPUB"), params, buf.Bytes()}, nil
+	return &Command{[]byte("MPUB"), params, finalizeMPubBody(buf)}, nil
 }
 
 // MultiPublish creates a new Command to write more than one message to a given topic
@@ -367,7 +536,7 @@ func MultiPublishTrace(topic string, part string, traceIDList []uint64, bodies [
 	if err != nil {
 		return nil, err
 	}
-	return &Command{[]byte("MPUB_TRACE"), params, buf.Bytes()}, nil
+	return &Command{[]byte("MPUB_TRACE"), params, finalizeMPubBody(buf)}, nil
 }
 
 func MultiPublishWithJsonExt(topic string, part string, extList []*MsgExt, bodies [][]byte) (*Command, error) {
@@ -379,7 +548,99 @@ func MultiPublishWithJsonExt(topic string, part string, extList []*MsgExt, bodie
 	if err != nil {
 		return nil, err
 	}
-	return &Command{[]byte("MPUB_EXT"), params, buf.Bytes()}, nil
+	return &Command{[]byte("MPUB_EXT"), params, finalizeMPubBody(buf)}, nil
+}
+
+func getMPubBodyWithMsgpackExt(extList []*MsgExt, bodies [][]byte) (*bytes.Buffer, error) {
+	num := uint32(len(bodies))
+	extBytesList := make([][]byte, num)
+	for i := range bodies {
+		extBytesList[i] = extList[i].ToMsgpack()
+	}
+	buf := getMPubBuffer()
+
+	err := binary.Write(buf, binary.BigEndian, &num)
+	if err != nil {
+		return nil, err
+	}
+	for i, b := range bodies {
+		err = binary.Write(buf, binary.BigEndian, int32(len(b)+2+len(extBytesList[i])))
+		if err != nil {
+			return nil, err
+		}
+		err = binary.Write(buf, binary.BigEndian, int16(len(extBytesList[i])))
+		if err != nil {
+			return nil, err
+		}
+		_, err = buf.Write(extBytesList[i])
+		if err != nil {
+			return nil, err
+		}
+		_, err = buf.Write(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// MultiPublishWithMsgpackExt behaves like MultiPublishWithJsonExt but encodes
+// each entry's ext header with MsgExt.ToMsgpack instead of MsgExt.ToJson.
+func MultiPublishWithMsgpackExt(topic string, part string, extList []*MsgExt, bodies [][]byte) (*Command, error) {
+	if len(extList) != len(bodies) {
+		return nil, errCommandArg
+	}
+	var params = [][]byte{[]byte(topic), []byte(part)}
+	buf, err := getMPubBodyWithMsgpackExt(extList, bodies)
+	if err != nil {
+		return nil, err
+	}
+	return &Command{[]byte("MPUB_EXT"), params, finalizeMPubBody(buf)}, nil
+}
+
+// buildMPubCommandFromEntries wraps pre-serialized MPUB-family entries (each already
+// length-prefixed, in the per-entry layout getMPubBody and friends write) into a single
+// command, prepending the entry count.
+func buildMPubCommandFromEntries(name string, topic string, part string, entries [][]byte) (*Command, error) {
+	var params [][]byte
+	if part != "" {
+		params = [][]byte{[]byte(topic), []byte(part)}
+	} else {
+		params = [][]byte{[]byte(topic)}
+	}
+
+	num := uint32(len(entries))
+	buf := getMPubBuffer()
+
+	err := binary.Write(buf, binary.BigEndian, &num)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		_, err = buf.Write(entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Command{[]byte(name), params, finalizeMPubBody(buf)}, nil
+}
+
+// MultiPublishEntries builds an MPUB command from pre-serialized entries,
+// as produced incrementally by Pipeline.Publish.
+func MultiPublishEntries(topic string, part string, entries [][]byte) (*Command, error) {
+	return buildMPubCommandFromEntries("MPUB", topic, part, entries)
+}
+
+// MultiPublishExtEntries builds an MPUB_EXT command from pre-serialized
+// entries, as produced incrementally by Pipeline.PublishWithJsonExt.
+func MultiPublishExtEntries(topic string, part string, entries [][]byte) (*Command, error) {
+	return buildMPubCommandFromEntries("MPUB_EXT", topic, part, entries)
+}
+
+// MultiPublishTraceEntries builds an MPUB_TRACE command from pre-serialized
+// entries, as produced incrementally by Pipeline.PublishTrace.
+func MultiPublishTraceEntries(topic string, part string, entries [][]byte) (*Command, error) {
+	return buildMPubCommandFromEntries("MPUB_TRACE", topic, part, entries)
 }
 
 // Subscribe creates a new Command to subscribe to the given topic/channel
@@ -403,7 +664,7 @@ func SubscribeWithPartAndTrace(topic string, channel string, part string) *Comma
 	return &Command{[]byte("SUB_ADVANCED"), params, nil}
 }
 
-//var offsetCountType = "count"
+var OffsetCountType = "count"
 var OffsetTimestampType = "timestamp"
 var OffsetVirtualQueueType = "virtual_queue"
 var OffsetSpecialType = "special"
@@ -413,10 +674,14 @@ type ConsumeOffset struct {
 	OffsetValue int64
 }
 
-//func (self *ConsumeOffset) SetCount(offset int64) {
-//	self.OffsetType = offsetCountType
-//	self.OffsetValue = offset
-//}
+// SetCount subscribes starting from the n-th message in the partition.
+// A negative n counts back |n| messages from the tail, mirroring Kafka's negative
+// offsets: SetCount(-1) starts at the last message in the partition,
+// SetCount(-100) starts 100 messages before the tail.
+func (self *ConsumeOffset) SetCount(n int64) {
+	self.OffsetType = OffsetCountType
+	self.OffsetValue = n
+}
 
 func (self *ConsumeOffset) SetToEnd() {
 	self.OffsetType = OffsetSpecialType
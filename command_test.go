@@ -0,0 +1,87 @@
+package nsq
+
+import (
+	"testing"
+)
+
+func benchmarkPublishCompressed(b *testing.B, size int, codec MessageCompression) {
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := PublishCompressed("topic", body, codec); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishCompressed1KNone(b *testing.B)   { benchmarkPublishCompressed(b, 1024, CompressNone) }
+func BenchmarkPublishCompressed1KSnappy(b *testing.B) { benchmarkPublishCompressed(b, 1024, CompressSnappy) }
+func BenchmarkPublishCompressed1KGzip(b *testing.B)   { benchmarkPublishCompressed(b, 1024, CompressGzip) }
+
+func BenchmarkPublishCompressed64KNone(b *testing.B) {
+	benchmarkPublishCompressed(b, 64*1024, CompressNone)
+}
+func BenchmarkPublishCompressed64KSnappy(b *testing.B) {
+	benchmarkPublishCompressed(b, 64*1024, CompressSnappy)
+}
+func BenchmarkPublishCompressed64KGzip(b *testing.B) {
+	benchmarkPublishCompressed(b, 64*1024, CompressGzip)
+}
+
+func TestConsumeOffsetToString(t *testing.T) {
+	var timeOffset, vqOffset, specialOffset, countOffset, negCountOffset ConsumeOffset
+	timeOffset.SetTime(100)
+	vqOffset.SetVirtualQueueOffset(5)
+	specialOffset.SetToEnd()
+	countOffset.SetCount(10)
+	negCountOffset.SetCount(-10)
+
+	cases := []struct {
+		name   string
+		offset ConsumeOffset
+		want   string
+	}{
+		{"timestamp", timeOffset, "timestamp:100"},
+		{"virtual_queue", vqOffset, "virtual_queue:5"},
+		{"special", specialOffset, "special:-1"},
+		{"count", countOffset, "count:10"},
+		{"count_negative", negCountOffset, "count:-10"},
+	}
+	for _, tc := range cases {
+		if got := tc.offset.ToString(); got != tc.want {
+			t.Errorf("%s: ToString() = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSubscribeAdvancedOffsetTypes(t *testing.T) {
+	var timeOffset, vqOffset, specialOffset, countOffset ConsumeOffset
+	timeOffset.SetTime(100)
+	vqOffset.SetVirtualQueueOffset(5)
+	specialOffset.SetToEnd()
+	countOffset.SetCount(-3)
+
+	for _, o := range []ConsumeOffset{timeOffset, vqOffset, specialOffset, countOffset} {
+		cmd := SubscribeAdvanced("topic", "channel", "0", o)
+		if string(cmd.Name) != "SUB_ADVANCED" {
+			t.Errorf("SubscribeAdvanced command name = %q, want SUB_ADVANCED", cmd.Name)
+		}
+		if len(cmd.Params) != 4 || string(cmd.Params[3]) != o.ToString() {
+			t.Errorf("SubscribeAdvanced params = %q, want offset param %q", cmd.Params, o.ToString())
+		}
+	}
+}
+
+func TestSubscribeOrderedHasNoOffsetParam(t *testing.T) {
+	cmd := SubscribeOrdered("topic", "channel", "0")
+	if string(cmd.Name) != "SUB_ORDERED" {
+		t.Errorf("SubscribeOrdered command name = %q, want SUB_ORDERED", cmd.Name)
+	}
+	if len(cmd.Params) != 3 {
+		t.Errorf("SubscribeOrdered params = %q, want 3 params (no offset)", cmd.Params)
+	}
+}
@@ -0,0 +1,228 @@
+package nsq
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// PipelineConfig controls how a Pipeline coalesces Publish calls into MPUB.
+// A zero value for any field disables that threshold (e.g. MaxLinger: 0
+// means never flush on a timer, only on size); NewPipeline special-cases
+// the fully zero-valued PipelineConfig{} to mean "use DefaultPipelineConfig"
+// instead, since a pipeline with every threshold disabled could never flush.
+type PipelineConfig struct {
+	MaxBatchSize int           // flush once this many messages are buffered, 0 disables
+	MaxBytes     int           // flush once this many body bytes are buffered, 0 disables
+	MaxLinger    time.Duration // flush this long after the first buffered message, 0 disables
+}
+
+// DefaultPipelineConfig is used by NewPipeline in place of a fully zero-valued PipelineConfig.
+var DefaultPipelineConfig = PipelineConfig{
+	MaxBatchSize: 100,
+	MaxBytes:     64 * 1024,
+	MaxLinger:    10 * time.Millisecond,
+}
+
+// PipelineSender flushes a coalesced MPUB-family command and reports a
+// result per message, in append order. No implementation ships in this
+// tree yet; a future Producer would implement it.
+type PipelineSender interface {
+	sendPipelineCommand(cmd *Command, n int) ([]error, error)
+}
+
+type pipelineKey struct {
+	topic     string
+	partition string
+	family    string
+}
+
+type pipelineEntry struct {
+	framed []byte
+	done   chan error
+}
+
+type pipelineBatch struct {
+	entries []*pipelineEntry
+	bytes   int
+	timer   *time.Timer
+}
+
+// Pipeline coalesces Publish calls into MPUB/MPUB_EXT/MPUB_TRACE commands,
+// flushed once MaxBatchSize, MaxBytes, or MaxLinger is reached.
+type Pipeline struct {
+	sender PipelineSender
+	config PipelineConfig
+
+	mtx     sync.Mutex
+	batches map[pipelineKey]*pipelineBatch
+}
+
+// NewPipeline creates a Pipeline that flushes batches through sender
+// according to config. The fully zero-valued PipelineConfig{} is replaced
+// with DefaultPipelineConfig; any other config, including one that
+// deliberately disables a threshold, is used as given.
+func NewPipeline(sender PipelineSender, config PipelineConfig) *Pipeline {
+	if config == (PipelineConfig{}) {
+		config = DefaultPipelineConfig
+	}
+	return &Pipeline{
+		sender:  sender,
+		config:  config,
+		batches: make(map[pipelineKey]*pipelineBatch),
+	}
+}
+
+// Publish buffers body for topic/partition and returns a channel that
+// receives the publish result once the batch it was coalesced into is
+// flushed.
+func (p *Pipeline) Publish(topic string, partition string, body []byte) <-chan error {
+	framed := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(framed, uint32(len(body)))
+	copy(framed[4:], body)
+	return p.enqueue(pipelineKey{topic: topic, partition: partition, family: "mpub"}, framed, len(body))
+}
+
+// PublishWithJsonExt behaves like Publish but attaches a JSON ext header,
+// coalescing into an MPUB_EXT command instead of MPUB.
+func (p *Pipeline) PublishWithJsonExt(topic string, partition string, body []byte, ext *MsgExt) <-chan error {
+	framed, err := framePipelineExtEntry(ext.ToJson(), body)
+	if err != nil {
+		return errChan(err)
+	}
+	return p.enqueue(pipelineKey{topic: topic, partition: partition, family: "mpub_ext"}, framed, len(body))
+}
+
+// PublishWithMsgpackExt behaves like PublishWithJsonExt but encodes the ext
+// header with msgpack instead of JSON, coalescing into the same MPUB_EXT
+// family (the encoding is negotiated once per connection via IDENTIFY, not
+// per entry).
+func (p *Pipeline) PublishWithMsgpackExt(topic string, partition string, body []byte, ext *MsgExt) <-chan error {
+	framed, err := framePipelineExtEntry(ext.ToMsgpack(), body)
+	if err != nil {
+		return errChan(err)
+	}
+	return p.enqueue(pipelineKey{topic: topic, partition: partition, family: "mpub_ext"}, framed, len(body))
+}
+
+// PublishTrace behaves like Publish but attaches a trace id, coalescing
+// into an MPUB_TRACE command instead of MPUB.
+func (p *Pipeline) PublishTrace(topic string, partition string, traceID uint64, body []byte) <-chan error {
+	framed := make([]byte, 4+8+len(body))
+	binary.BigEndian.PutUint32(framed, uint32(8+len(body)))
+	binary.BigEndian.PutUint64(framed[4:], traceID)
+	copy(framed[12:], body)
+	return p.enqueue(pipelineKey{topic: topic, partition: partition, family: "mpub_trace"}, framed, len(body))
+}
+
+// framePipelineExtEntry frames an ext header and body into the 2-byte
+// length prefix + header + body layout shared by MPUB_EXT entries,
+// rejecting headers that don't fit the prefix's uint16 range.
+func framePipelineExtEntry(ext []byte, body []byte) ([]byte, error) {
+	if len(ext) > 65535 {
+		return nil, errCommandArg
+	}
+	framed := make([]byte, 4+2+len(ext)+len(body))
+	binary.BigEndian.PutUint32(framed, uint32(2+len(ext)+len(body)))
+	binary.BigEndian.PutUint16(framed[4:], uint16(len(ext)))
+	copy(framed[6:], ext)
+	copy(framed[6+len(ext):], body)
+	return framed, nil
+}
+
+// errChan returns an already-resolved future (holding err, not closed) for a Publish
+// variant that failed validation before it could be enqueued.
+func errChan(err error) <-chan error {
+	done := make(chan error, 1)
+	done <- err
+	return done
+}
+
+func (p *Pipeline) enqueue(key pipelineKey, framed []byte, bodyLen int) <-chan error {
+	done := make(chan error, 1)
+	entry := &pipelineEntry{framed: framed, done: done}
+
+	p.mtx.Lock()
+	batch, ok := p.batches[key]
+	if !ok {
+		batch = &pipelineBatch{}
+		p.batches[key] = batch
+		if p.config.MaxLinger > 0 {
+			batch.timer = time.AfterFunc(p.config.MaxLinger, func() {
+				p.flush(key)
+			})
+		}
+	}
+	batch.entries = append(batch.entries, entry)
+	batch.bytes += bodyLen
+
+	flushNow := (p.config.MaxBatchSize > 0 && len(batch.entries) >= p.config.MaxBatchSize) ||
+		(p.config.MaxBytes > 0 && batch.bytes >= p.config.MaxBytes)
+	p.mtx.Unlock()
+
+	if flushNow {
+		p.flush(key)
+	}
+
+	return done
+}
+
+// Flush immediately sends the pending batches for topic/partition, if any.
+func (p *Pipeline) Flush(topic string, partition string) {
+	for _, family := range []string{"mpub", "mpub_ext", "mpub_trace"} {
+		p.flush(pipelineKey{topic: topic, partition: partition, family: family})
+	}
+}
+
+func (p *Pipeline) flush(key pipelineKey) {
+	p.mtx.Lock()
+	batch, ok := p.batches[key]
+	if ok {
+		delete(p.batches, key)
+	}
+	p.mtx.Unlock()
+
+	if !ok {
+		return
+	}
+	if batch.timer != nil {
+		batch.timer.Stop()
+	}
+	if len(batch.entries) == 0 {
+		return
+	}
+
+	entries := make([][]byte, len(batch.entries))
+	for i, e := range batch.entries {
+		entries[i] = e.framed
+	}
+
+	var cmd *Command
+	var err error
+	switch key.family {
+	case "mpub_ext":
+		cmd, err = MultiPublishExtEntries(key.topic, key.partition, entries)
+	case "mpub_trace":
+		cmd, err = MultiPublishTraceEntries(key.topic, key.partition, entries)
+	default:
+		cmd, err = MultiPublishEntries(key.topic, key.partition, entries)
+	}
+	if err != nil {
+		for _, e := range batch.entries {
+			e.done <- err
+		}
+		return
+	}
+
+	results, sendErr := p.sender.sendPipelineCommand(cmd, len(batch.entries))
+	if sendErr == nil && len(results) != len(batch.entries) {
+		sendErr = errCommandArg
+	}
+	for i, e := range batch.entries {
+		if sendErr != nil {
+			e.done <- sendErr
+		} else {
+			e.done <- results[i]
+		}
+	}
+}